@@ -10,18 +10,21 @@ import (
 	"fmt"
 	"github.com/BurntSushi/toml"
 	"github.com/Dieterbe/statsd-go"
+	"github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
 	"github.com/graphite-ng/carbon-relay-ng/admin"
 	"github.com/graphite-ng/carbon-relay-ng/routing"
 	"github.com/rcrowley/goagain"
 	"html/template"
 	"io"
-	"log"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
 	"runtime/pprof"
 	"strings"
+	"time"
 )
 
 type StatsdConfig struct {
@@ -31,14 +34,20 @@ type StatsdConfig struct {
 	Port     int
 }
 
+type LogConfig struct {
+	Level  string // debug, info, warn, error
+	Format string // text, json
+}
+
 type Config struct {
 	Listen_addr string
 	Admin_addr  string
 	Http_addr   string
 	Spool_dir   string
 	First_only  bool
-	Routes      map[string]*routing.Route
+	Routes      map[string]*routing.RouteConfig
 	Statsd      StatsdConfig
+	Log         LogConfig
 }
 
 var (
@@ -48,17 +57,30 @@ var (
 	routes       *routing.Routes
 	statsdClient statsd.Client
 	cpuprofile   = flag.String("cpuprofile", "", "write cpu profile to file")
+	logger       = logrus.StandardLogger()
 )
 
-func init() {
-	log.SetFlags(log.Ltime | log.Lmicroseconds | log.Lshortfile)
+// setupLogging applies the configured level and formatter to the standard
+// logrus logger, used both here and in the routing package.
+func setupLogging(cfg LogConfig) {
+	switch strings.ToLower(cfg.Format) {
+	case "json":
+		logrus.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		logrus.SetFormatter(&logrus.TextFormatter{})
+	}
+	level, err := logrus.ParseLevel(cfg.Level)
+	if err != nil {
+		level = logrus.InfoLevel
+	}
+	logrus.SetLevel(level)
 }
 
 func accept(l *net.TCPListener, config Config) {
 	for {
 		c, err := l.AcceptTCP()
 		if nil != err {
-			log.Println(err)
+			logger.WithError(err).Warn("accept failed")
 			break
 		}
 		go handle(c, config)
@@ -73,12 +95,12 @@ func handle(c *net.TCPConn, config Config) {
 		buf, isPrefix, err := r.ReadLine()
 		if nil != err {
 			if io.EOF != err {
-				log.Println(err)
+				logger.WithError(err).Warn("read failed")
 			}
 			break
 		}
 		if isPrefix { // TODO Recover from partial reads.
-			log.Println("isPrefix: true")
+			logger.Warn("isPrefix: true")
 			break
 		}
 		buf = append(buf, '\n')
@@ -90,22 +112,35 @@ func handle(c *net.TCPConn, config Config) {
 }
 
 func Router() {
-	fmt.Printf("config.First_only: %v", config.First_only)
+	logger.WithField("first_only", config.First_only).Info("router starting")
 	for buf := range to_dispatch {
 		routed := routes.Dispatch(buf, config.First_only)
 		if !routed {
-			log.Printf("unrouteable: %s\n", buf)
+			logger.WithField("bytes", len(buf)).Warnf("unrouteable: %s", buf)
 		}
 	}
 }
 
+// traceAdminCmd logs the raw admin command when CRNGTRACE=admin (or all) is set.
+func traceAdminCmd(req admin.Req) {
+	if routing.TraceAdmin {
+		logger.WithField("command", req.Command).Info("admin command")
+	}
+}
+
 func tcpListHandler(req admin.Req) (err error) {
+	traceAdminCmd(req)
 	if len(req.Command) != 2 {
 		return errors.New("extraneous arguments")
 	}
 	longest_key := 9
 	longest_patt := 9
 	longest_addr := 9
+	longest_kind := 4
+	longest_queue := 5
+	longest_spool_depth := 11
+	longest_err := 10
+	longest_connect := 12
 	list := routes.List()
 	for key, route := range list {
 		if len(key) > longest_key {
@@ -114,19 +149,38 @@ func tcpListHandler(req admin.Req) (err error) {
 		if len(route.Patt) > longest_patt {
 			longest_patt = len(route.Patt)
 		}
-		if len(route.Addr) > longest_addr {
-			longest_addr = len(route.Addr)
+		if len(route.DestAddrs()) > longest_addr {
+			longest_addr = len(route.DestAddrs())
+		}
+		if len(route.Kind) > longest_kind {
+			longest_kind = len(route.Kind)
+		}
+		if len(route.QueueDepths()) > longest_queue {
+			longest_queue = len(route.QueueDepths())
+		}
+		if len(route.SpoolDepths()) > longest_spool_depth {
+			longest_spool_depth = len(route.SpoolDepths())
+		}
+		if len(route.LastErrors()) > longest_err {
+			longest_err = len(route.LastErrors())
+		}
+		if len(route.LastConnects()) > longest_connect {
+			longest_connect = len(route.LastConnects())
 		}
 	}
-	fmt_str := fmt.Sprintf("%%%ds %%%ds %%%ds %%8v\n", longest_key+1, longest_patt+1, longest_addr+1)
-	(*req.Conn).Write([]byte(fmt.Sprintf(fmt_str, "key", "pattern", "addr", "spool")))
+	fmt_str := fmt.Sprintf("%%%ds %%%ds %%%ds %%%ds %%8v %%%ds %%%ds %%%ds %%%ds\n",
+		longest_key+1, longest_patt+1, longest_kind+1, longest_addr+1,
+		longest_queue+1, longest_spool_depth+1, longest_err+1, longest_connect+1)
+	(*req.Conn).Write([]byte(fmt.Sprintf(fmt_str, "key", "pattern", "kind", "addr", "spool", "queue", "spool_depth", "last_error", "last_connect")))
 	for key, route := range list {
-		(*req.Conn).Write([]byte(fmt.Sprintf(fmt_str, key, route.Patt, route.Addr, route.Spool)))
+		(*req.Conn).Write([]byte(fmt.Sprintf(fmt_str, key, route.Patt, route.Kind, route.DestAddrs(), route.Spool,
+			route.QueueDepths(), route.SpoolDepths(), route.LastErrors(), route.LastConnects())))
 	}
 	(*req.Conn).Write([]byte("--\n"))
 	return
 }
 func tcpAddHandler(req admin.Req) (err error) {
+	traceAdminCmd(req)
 	key := req.Command[2]
 	var patt, addr, spool_str string
 	if len(req.Command) == 5 {
@@ -154,7 +208,55 @@ func tcpAddHandler(req admin.Req) (err error) {
 	return
 }
 
+// tcpAddClusterHandler builds a handler for "route add <kind> <key> <patt> <addr1,addr2,...> <spool>",
+// i.e. a route that fans out to more than one destination.
+func tcpAddClusterHandler(kind string) func(admin.Req) error {
+	return func(req admin.Req) (err error) {
+		traceAdminCmd(req)
+		if len(req.Command) != 7 {
+			return errors.New("bad number of arguments")
+		}
+		key := req.Command[3]
+		patt := req.Command[4]
+		addrs := strings.Split(req.Command[5], ",")
+		spool := req.Command[6] == "1"
+
+		err = routes.AddCluster(key, patt, kind, addrs, spool, &statsdClient)
+		if err != nil {
+			return err
+		}
+		(*req.Conn).Write([]byte("added\n"))
+		return
+	}
+}
+
+// tcpAddAggHandler handles "route add agg <key> <patt> <template> <func> <interval>",
+// an aggregate route. Late-arrival window defaults to one interval, and
+// cardinality is unlimited; use a TOML route definition to customize either.
+func tcpAddAggHandler(req admin.Req) (err error) {
+	traceAdminCmd(req)
+	if len(req.Command) != 8 {
+		return errors.New("bad number of arguments")
+	}
+	key := req.Command[3]
+	patt := req.Command[4]
+	template := req.Command[5]
+	fn := req.Command[6]
+	interval, err := time.ParseDuration(req.Command[7])
+	if err != nil {
+		return err
+	}
+
+	err = routes.AddAggregate(key, patt, template, fn, interval, interval, 0, &statsdClient)
+	if err != nil {
+		return err
+	}
+	(*req.Conn).Write([]byte("added\n"))
+	return
+}
+
 func tcpDelHandler(req admin.Req) (err error) {
+	traceAdminCmd(req)
 	if len(req.Command) != 3 {
 		return errors.New("bad number of arguments")
 	}
@@ -168,6 +270,7 @@ func tcpDelHandler(req admin.Req) (err error) {
 }
 
 func tcpPattHandler(req admin.Req) (err error) {
+	traceAdminCmd(req)
 	key := req.Command[2]
 	var patt string
 	if len(req.Command) == 4 {
@@ -199,11 +302,15 @@ func writeHelp(conn net.Conn, write_first []byte) { // bytes.Buffer
 	conn.Write(write_first)
 	help := `
 commands:
-    help                                     show this menu
-    route list                               list routes
-    route add <key> [pattern] <addr> <spool> add the route. (empty pattern allows all). (spool has to be 1 or 0)
-    route del <key>                          delete the matching route
-    route patt <key> [pattern]               update pattern for given route key.  (empty pattern allows all)
+    help                                                        show this menu
+    route list                                                  list routes
+    route add <key> [pattern] <addr> <spool>                    add a single-destination route. (empty pattern allows all). (spool has to be 1 or 0)
+    route add hash <key> <pattern> <addr1,addr2,...> <spool>     add a route that consistent-hashes metrics across destinations
+    route add replicate <key> <pattern> <addr1,addr2,...> <spool> add a route that sends every metric to all destinations
+    route add rr <key> <pattern> <addr1,addr2,...> <spool>       add a route that round-robins metrics across destinations
+    route add agg <key> <pattern> <template> <func> <interval>  add a route that aggregates metrics (func: sum/avg/min/max/count/last/p50/p90/p99, interval like 10s)
+    route del <key>                                             delete the matching route
+    route patt <key> [pattern]                                  update pattern for given route key.  (empty pattern allows all)
 
 `
 	conn.Write([]byte(help))
@@ -212,16 +319,20 @@ commands:
 func adminListener() {
 	admin.HandleFunc("route list", tcpListHandler)
 	admin.HandleFunc("route add", tcpAddHandler)
+	admin.HandleFunc("route add hash", tcpAddClusterHandler("consistent_hash"))
+	admin.HandleFunc("route add replicate", tcpAddClusterHandler("replicate"))
+	admin.HandleFunc("route add rr", tcpAddClusterHandler("round_robin"))
+	admin.HandleFunc("route add agg", tcpAddAggHandler)
 	admin.HandleFunc("route del", tcpDelHandler)
 	admin.HandleFunc("route patt", tcpPattHandler)
 	admin.HandleFunc("help", tcpHelpHandler)
 	admin.HandleFunc("", tcpDefaultHandler)
 	err := admin.ListenAndServe(config.Admin_addr)
 	if err != nil {
-		fmt.Println("Error listening:", err.Error())
+		logger.WithError(err).Error("error listening")
 		os.Exit(1)
 	}
-	log.Printf("listening on %v", config.Admin_addr)
+	logger.WithField("addr", config.Admin_addr).Info("listening")
 }
 
 func homeHandler(w http.ResponseWriter, r *http.Request, title string) {
@@ -237,13 +348,17 @@ func homeHandler(w http.ResponseWriter, r *http.Request, title string) {
 
 func editHandler(w http.ResponseWriter, r *http.Request, title string) {
 	key := r.URL.Path[len("/edit/"):]
-	route := routes.Map[key]
-	fmt.Printf("Editting %s with %s - %s \n", route.Key, route.Patt, route.Addr)
+	route, ok := routes.Get(key)
+	if !ok {
+		http.Error(w, "unknown route '"+key+"'", http.StatusNotFound)
+		return
+	}
+	fmt.Printf("Editting %s with %s - %s \n", route.Key, route.Patt, route.DestAddrs())
 
 	tc := make(map[string]interface{})
 	tc["Title"] = title
 	tc["Key"] = route.Key
-	tc["Addr"] = route.Addr
+	tc["Addr"] = route.DestAddrs()
 	tc["Patt"] = route.Patt
 
 	templates := template.Must(loadTemplates("templates/base.html", "templates/edit.html"))
@@ -301,19 +416,101 @@ func makeHandler(fn func(http.ResponseWriter, *http.Request, string)) http.Handl
 	}
 }
 
+// checkOrigin rejects cross-origin WebSocket upgrades. /ws/tail and /ws/events
+// stream live production metric traffic, so allowing any origin would let a
+// page served elsewhere drive a visiting browser into opening a websocket
+// here and exfiltrating that traffic (cross-site WebSocket hijacking). Only
+// same-origin requests (or clients that don't send an Origin header at all,
+// e.g. non-browser websocket tools) are allowed.
+func checkOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return u.Host == r.Host
+}
+
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 1024,
+	CheckOrigin:     checkOrigin,
+}
+
+// wsTailHandler streams every metric line dispatched to the route named by
+// the URL (or every unrouteable line, for the special key "_unrouted") to a
+// browser, so operators can watch traffic live instead of ssh+tail -f'ing.
+func wsTailHandler(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Path[len("/ws/tail/"):]
+	ch := make(chan []byte, 100)
+
+	if key == "_unrouted" {
+		routes.AddUnroutedListener(ch)
+		defer routes.RemoveUnroutedListener(ch)
+	} else {
+		route, ok := routes.Get(key)
+		if !ok {
+			http.Error(w, "unknown route '"+key+"'", http.StatusNotFound)
+			return
+		}
+		route.AddListener(ch)
+		defer route.RemoveListener(ch)
+	}
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.WithError(err).Warn("websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	for buf := range ch {
+		if err := conn.WriteMessage(websocket.TextMessage, buf); err != nil {
+			return
+		}
+	}
+}
+
+// wsEventsHandler streams route lifecycle events (connect/disconnect,
+// spool-in/spool-out, pattern/addr updates) so operators can watch relay
+// health live from a browser.
+func wsEventsHandler(w http.ResponseWriter, r *http.Request) {
+	ch := make(chan routing.Event, 100)
+	routes.AddEventListener(ch)
+	defer routes.RemoveEventListener(ch)
+
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.WithError(err).Warn("websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	for event := range ch {
+		if err := conn.WriteJSON(event); err != nil {
+			return
+		}
+	}
+}
+
 func httpListener() {
 	// TODO treat errors like 'not found' etc differently, don't just return http.StatusInternalServerError in all cases
 	http.HandleFunc("/edit/", makeHandler(editHandler))
 	http.HandleFunc("/save/", makeHandler(saveHandler))
 	http.HandleFunc("/update/", makeHandler(updateHandler))
 	http.HandleFunc("/delete/", makeHandler(deleteHandler))
+	http.HandleFunc("/ws/tail/", wsTailHandler)
+	http.HandleFunc("/ws/events", wsEventsHandler)
 	http.HandleFunc("/", makeHandler(homeHandler))
 	err := http.ListenAndServe(config.Http_addr, nil)
 	if err != nil {
-		fmt.Println("Error listening:", err.Error())
+		logger.WithError(err).Error("error listening")
 		os.Exit(1)
 	}
-	log.Printf("listening on %v", config.Http_addr)
+	logger.WithField("addr", config.Http_addr).Info("listening")
 }
 
 func usage() {
@@ -342,20 +539,22 @@ func main() {
 		metadata = md
 	}
 
+	setupLogging(config.Log)
+
 	if *cpuprofile != "" {
 		f, err := os.Create(*cpuprofile)
 		if err != nil {
-			log.Fatal(err)
+			logger.WithError(err).Fatal("could not create cpuprofile")
 		}
 		pprof.StartCPUProfile(f)
 		defer pprof.StopCPUProfile()
 	}
 
-	log.Println("initializing routes...")
+	logger.Info("initializing routes...")
 	var err error
 	routes, err = routing.NewRoutes(config.Routes, config.Spool_dir, &statsdClient)
 	if err != nil {
-		log.Println(err)
+		logger.WithError(err).Error("could not initialize routes")
 		os.Exit(1)
 	}
 
@@ -370,7 +569,7 @@ func main() {
 
 	err = routes.Run()
 	if err != nil {
-		log.Println(err)
+		logger.WithError(err).Error("could not run routes")
 		os.Exit(1)
 	}
 
@@ -382,21 +581,21 @@ func main() {
 	if nil != err {
 		laddr, err := net.ResolveTCPAddr("tcp", config.Listen_addr)
 		if nil != err {
-			log.Println(err)
+			logger.WithError(err).Error("could not resolve listen addr")
 			os.Exit(1)
 		}
 		l, err = net.ListenTCP("tcp", laddr)
 		if nil != err {
-			log.Println(err)
+			logger.WithError(err).Error("could not listen")
 			os.Exit(1)
 		}
-		log.Printf("listening on %v", laddr)
+		logger.WithField("addr", laddr).Info("listening")
 		go accept(l.(*net.TCPListener), config)
 	} else {
-		log.Printf("resuming listening on %v", l.Addr())
+		logger.WithField("addr", l.Addr()).Info("resuming listening")
 		go accept(l.(*net.TCPListener), config)
 		if err := goagain.KillParent(ppid); nil != err {
-			log.Println(err)
+			logger.WithError(err).Error("could not kill parent")
 			os.Exit(1)
 		}
 	}
@@ -412,7 +611,7 @@ func main() {
 	go Router()
 
 	if err := goagain.AwaitSignals(l); nil != err {
-		log.Println(err)
+		logger.WithError(err).Error("error awaiting signals")
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,275 @@
+package routing
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/Dieterbe/statsd-go"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AggConfig bundles the settings specific to an "aggregate"-kind route. It's
+// only consulted by NewRoute when kind == "aggregate".
+type AggConfig struct {
+	Template       string        // output metric name, "$1"-style refs into Patt's capture groups
+	Func           string        // sum, avg, min, max, count, last, p50, p90, p99
+	Interval       time.Duration // bucket size / flush interval
+	LateWindow     time.Duration // accept samples up to this long after a bucket's interval closes
+	MaxCardinality int           // max distinct output names tracked at once, 0 means unlimited
+}
+
+func validateAggFunc(fn string) error {
+	switch fn {
+	case "sum", "avg", "min", "max", "count", "last":
+		return nil
+	}
+	if strings.HasPrefix(fn, "p") {
+		if pct, err := strconv.Atoi(fn[1:]); err == nil && pct >= 0 && pct <= 100 {
+			return nil
+		}
+	}
+	return errors.New("unknown aggregation func '" + fn + "'")
+}
+
+// maxReservoirSamples bounds the per-bucket sample reservoir used by
+// percentile funcs (pNN). Without a cap, a busy bucket (e.g. a p99 rollup fed
+// by many series over its interval) would grow samples unboundedly and pay
+// an O(n log n) sort on every flush; percentiles become an approximation
+// over a bounded random subsample instead.
+const maxReservoirSamples = 100
+
+// aggBucket accumulates the samples for one output name over one interval.
+type aggBucket struct {
+	outputName string
+	ts         time.Time // start of the bucket
+	count      int64
+	sum        float64
+	min        float64
+	max        float64
+	last       float64
+	samples    []float64 // bounded reservoir, only kept for percentile funcs
+	sampleSeen int64     // total values offered to the reservoir, for Algorithm R
+}
+
+func (b *aggBucket) add(value float64) {
+	if b.count == 0 {
+		b.min = value
+		b.max = value
+	} else {
+		if value < b.min {
+			b.min = value
+		}
+		if value > b.max {
+			b.max = value
+		}
+	}
+	b.count++
+	b.sum += value
+	b.last = value
+}
+
+// recordSample adds value to the bucket's bounded sample reservoir using
+// reservoir sampling (Algorithm R), so every value seen has an equal chance
+// of being retained once the reservoir fills up.
+func (b *aggBucket) recordSample(value float64) {
+	b.sampleSeen++
+	if len(b.samples) < maxReservoirSamples {
+		b.samples = append(b.samples, value)
+		return
+	}
+	if i := rand.Int63n(b.sampleSeen); i < int64(len(b.samples)) {
+		b.samples[i] = value
+	}
+}
+
+func (b *aggBucket) value(fn string) float64 {
+	switch fn {
+	case "sum":
+		return b.sum
+	case "avg":
+		return b.sum / float64(b.count)
+	case "min":
+		return b.min
+	case "max":
+		return b.max
+	case "count":
+		return float64(b.count)
+	case "last":
+		return b.last
+	default: // pNN
+		pct, _ := strconv.Atoi(fn[1:])
+		return percentile(b.samples, float64(pct)/100)
+	}
+}
+
+// percentile returns the p'th percentile (0 <= p <= 1) of samples using
+// linear interpolation between closest ranks, carbon-aggregator style. p is
+// clamped to [0, 1] so a malformed func that slipped past validateAggFunc
+// can't index sorted out of bounds.
+func percentile(samples []float64, p float64) float64 {
+	if len(samples) == 0 {
+		return 0
+	}
+	if p < 0 {
+		p = 0
+	} else if p > 1 {
+		p = 1
+	}
+	sorted := make([]float64, len(samples))
+	copy(sorted, samples)
+	sort.Float64s(sorted)
+	if len(sorted) == 1 {
+		return sorted[0]
+	}
+	rank := p * float64(len(sorted)-1)
+	lo := int(rank)
+	hi := lo + 1
+	if hi >= len(sorted) {
+		return sorted[lo]
+	}
+	frac := rank - float64(lo)
+	return sorted[lo] + frac*(sorted[hi]-sorted[lo])
+}
+
+func needsSamples(fn string) bool {
+	return strings.HasPrefix(fn, "p")
+}
+
+// aggregator accumulates samples for one "aggregate" route and periodically
+// flushes them back into the dispatch path via its dispatch callback, one
+// Graphite line per output bucket.
+type aggregator struct {
+	routeKey       string
+	fn             string
+	interval       time.Duration
+	lateWindow     time.Duration
+	maxCardinality int
+	instrument     *statsd.Client
+	dispatch       func([]byte)
+
+	mu          sync.Mutex
+	buckets     map[string]*aggBucket // keyed by outputName + bucket start
+	activeNames map[string]int        // refcounts, for the cardinality guard
+
+	ticker   *time.Ticker
+	shutdown chan bool
+}
+
+func newAggregator(routeKey, fn string, interval, lateWindow time.Duration, maxCardinality int, instrument *statsd.Client, dispatch func([]byte)) *aggregator {
+	return &aggregator{
+		routeKey:       routeKey,
+		fn:             fn,
+		interval:       interval,
+		lateWindow:     lateWindow,
+		maxCardinality: maxCardinality,
+		instrument:     instrument,
+		dispatch:       dispatch,
+		buckets:        make(map[string]*aggBucket),
+		activeNames:    make(map[string]int),
+		shutdown:       make(chan bool),
+	}
+}
+
+func (a *aggregator) Run() {
+	a.ticker = time.NewTicker(a.interval)
+	go func() {
+		for {
+			select {
+			case t := <-a.ticker.C:
+				a.flush(t)
+			case <-a.shutdown:
+				a.ticker.Stop()
+				return
+			}
+		}
+	}()
+}
+
+func (a *aggregator) Shutdown() {
+	close(a.shutdown)
+}
+
+func bucketKey(outputName string, bucketStart time.Time) string {
+	return outputName + "|" + strconv.FormatInt(bucketStart.Unix(), 10)
+}
+
+// addSample files value, observed at ts, under outputName's bucket. Samples
+// whose bucket has already closed by more than lateWindow are dropped and
+// counted; new output names beyond maxCardinality are dropped and counted.
+func (a *aggregator) addSample(outputName string, value float64, ts time.Time) {
+	bucketStart := ts.Truncate(a.interval)
+	if time.Since(bucketStart) > a.interval+a.lateWindow {
+		a.instrument.Increment("route=" + a.routeKey + ".target_type=count.unit=Metric.direction=agg_drop_late")
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	key := bucketKey(outputName, bucketStart)
+	b, found := a.buckets[key]
+	if !found {
+		if a.maxCardinality > 0 && a.activeNames[outputName] == 0 && len(a.activeNames) >= a.maxCardinality {
+			a.instrument.Increment("route=" + a.routeKey + ".target_type=count.unit=Metric.direction=agg_drop_cardinality")
+			return
+		}
+		b = &aggBucket{outputName: outputName, ts: bucketStart}
+		a.buckets[key] = b
+		a.activeNames[outputName]++
+	}
+	b.add(value)
+	if needsSamples(a.fn) {
+		b.recordSample(value)
+	}
+}
+
+// flush emits one Graphite line per bucket whose interval plus late-arrival
+// window has fully elapsed, then forgets those buckets.
+func (a *aggregator) flush(now time.Time) {
+	a.mu.Lock()
+	var due []*aggBucket
+	for key, b := range a.buckets {
+		if now.Sub(b.ts) >= a.interval+a.lateWindow {
+			due = append(due, b)
+			delete(a.buckets, key)
+			a.activeNames[b.outputName]--
+			if a.activeNames[b.outputName] <= 0 {
+				delete(a.activeNames, b.outputName)
+			}
+		}
+	}
+	a.mu.Unlock()
+
+	for _, b := range due {
+		line := []byte(fmt.Sprintf("%s %v %d\n", b.outputName, b.value(a.fn), b.ts.Unix()))
+		a.dispatch(line)
+	}
+}
+
+// aggregateSample extracts the metric name, value and timestamp from a
+// plaintext Graphite line, rewrites the name via route.Template using Patt's
+// capture groups, and feeds the result into the route's aggregator.
+func (route *Route) aggregateSample(buf []byte) {
+	match := route.Reg.FindSubmatchIndex(buf)
+	if match == nil {
+		return
+	}
+	fields := bytes.Fields(buf)
+	if len(fields) != 3 {
+		return
+	}
+	value, err := strconv.ParseFloat(string(fields[1]), 64)
+	if err != nil {
+		return
+	}
+	epoch, err := strconv.ParseInt(string(fields[2]), 10, 64)
+	if err != nil {
+		return
+	}
+	outputName := string(route.Reg.ExpandString(nil, route.Template, buf, match))
+	route.agg.addSample(outputName, value, time.Unix(epoch, 0))
+}
@@ -1,69 +1,226 @@
 package routing
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"github.com/Dieterbe/statsd-go"
+	"github.com/Sirupsen/logrus"
 	"github.com/graphite-ng/carbon-relay-ng/nsqd"
-	"log"
 	"net"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var logger = logrus.StandardLogger()
+
+const vnodesPerDestination = 100 // virtual nodes per destination on the consistent-hash ring
+
 type Route struct {
 	// basic properties in init and copy
 	Key        string         // to identify in stats/logs
 	Patt       string         // regex string
-	Addr       string         // tcp dest
+	Kind       string         // "single" (default), "replicate", "round_robin", "consistent_hash", "aggregate"
 	spoolDir   string         // where to store spool files (if enabled)
 	Spool      bool           // spool metrics to disk while endpoint down?
 	instrument *statsd.Client // to submit stats to
+	events     chan<- Event   // to publish route lifecycle events, if anyone's listening
 
 	// set automatically in init, passed on in copy
 	Reg *regexp.Regexp // compiled version of patt
 
 	// set in/via Run()
-	ch           chan []byte       // to pump data to dest
-	shutdown     chan bool         // signals shutdown internally
-	queue        *nsqd.DiskQueue   // queue used if spooling enabled
-	raddr        *net.TCPAddr      // resolved remote addr
-	connUpdates  chan *net.TCPConn // when the route connects to a new endpoint (possibly nil)
-	inConnUpdate chan bool         // to signal when we start a new conn and when we finish
+	Destinations []*Destination
+	ring         ringSlice // built from Destinations, used by Kind == "consistent_hash"
+	rrCounter    uint32    // cursor for Kind == "round_robin", atomic
+
+	// Kind == "aggregate" only: Patt's capture groups feed Template to build
+	// an output name, whose samples get accumulated and flushed by agg.
+	Template       string
+	AggFunc        string
+	Interval       time.Duration
+	LateWindow     time.Duration
+	MaxCardinality int
+	agg            *aggregator
+
+	// tailing
+	listenersLock sync.RWMutex
+	listeners     []chan []byte // live-tail subscribers, fed a copy of every matched metric
+}
+
+// Event is a route lifecycle notification, meant for live operator visibility
+// (see Routes.AddEventListener), not for metrics flow.
+type Event struct {
+	Type      string // "connect", "disconnect", "spool_in", "spool_out", "patt_update", "addr_update"
+	Route     string
+	Detail    string
+	Timestamp time.Time
+}
+
+func publishEvent(events chan<- Event, typ, route, detail string) {
+	if events == nil {
+		return
+	}
+	select {
+	case events <- Event{Type: typ, Route: route, Detail: detail, Timestamp: time.Now()}:
+	default:
+		// event subscriber too slow, drop rather than block the relay
+	}
+}
+
+// AddListener registers ch to receive a copy of every metric line that
+// passes through this route, for as long as the caller keeps consuming it.
+// Slow consumers get dropped metrics, never a stalled relay.
+func (route *Route) AddListener(ch chan []byte) {
+	route.listenersLock.Lock()
+	defer route.listenersLock.Unlock()
+	route.listeners = append(route.listeners, ch)
+}
+
+// RemoveListener unregisters a channel previously passed to AddListener.
+func (route *Route) RemoveListener(ch chan []byte) {
+	route.listenersLock.Lock()
+	defer route.listenersLock.Unlock()
+	for i, l := range route.listeners {
+		if l == ch {
+			route.listeners = append(route.listeners[:i], route.listeners[i+1:]...)
+			return
+		}
+	}
+}
+
+func (route *Route) publish(buf []byte) {
+	route.listenersLock.RLock()
+	defer route.listenersLock.RUnlock()
+	for _, ch := range route.listeners {
+		select {
+		case ch <- buf:
+		default:
+			route.instrument.Increment("route=" + route.Key + ".target_type=count.unit=Metric.direction=tail_drop")
+		}
+	}
 }
 
 // after creating, run Run()!
-func NewRoute(key, patt, addr, spoolDir string, spool bool, instrument *statsd.Client) (*Route, error) {
+// agg and dispatchBack are only used when kind == "aggregate": agg carries
+// the aggregation settings, dispatchBack re-injects flushed bucket lines into
+// Routes.Dispatch so downstream routes still apply. Both are ignored for
+// other kinds (agg may be nil then).
+func NewRoute(key, patt, kind string, addrs []string, spoolDir string, spool bool, queueSize int, dropNewest bool, agg *AggConfig, dispatchBack func([]byte), instrument *statsd.Client, events chan<- Event) (*Route, error) {
+	if kind == "" {
+		kind = "single"
+	}
 	route := &Route{
 		Key:        key,
-		Patt:       "",
-		Addr:       addr,
+		Kind:       kind,
 		spoolDir:   spoolDir,
 		Spool:      spool,
 		instrument: instrument,
+		events:     events,
+	}
+	for _, addr := range addrs {
+		route.Destinations = append(route.Destinations, NewDestination(key, addr, spoolDir, spool, queueSize, dropNewest, instrument, events))
 	}
-	err := route.updatePattern(patt)
+	route.buildRing()
+	err := route.compilePattern(patt)
 	if err != nil {
 		return nil, err
 	}
+	if kind == "aggregate" {
+		if agg == nil || agg.Interval <= 0 {
+			return nil, errors.New("aggregate route requires a template, func and interval")
+		}
+		if err := validateAggFunc(agg.Func); err != nil {
+			return nil, err
+		}
+		route.Template = agg.Template
+		route.AggFunc = agg.Func
+		route.Interval = agg.Interval
+		route.LateWindow = agg.LateWindow
+		route.MaxCardinality = agg.MaxCardinality
+		route.agg = newAggregator(key, agg.Func, agg.Interval, agg.LateWindow, agg.MaxCardinality, instrument, dispatchBack)
+	}
 	return route, nil
 }
 
 // a "basic" static copy of the route, not actually running
 func (route *Route) Copy() *Route {
 	return &Route{
-		Key:        route.Key,
-		Patt:       route.Patt,
-		Addr:       route.Addr,
-		spoolDir:   route.spoolDir,
-		Spool:      route.Spool,
-		instrument: route.instrument,
-		Reg:        route.Reg,
+		Key:            route.Key,
+		Patt:           route.Patt,
+		Kind:           route.Kind,
+		spoolDir:       route.spoolDir,
+		Spool:          route.Spool,
+		instrument:     route.instrument,
+		Reg:            route.Reg,
+		Destinations:   route.Destinations,
+		Template:       route.Template,
+		AggFunc:        route.AggFunc,
+		Interval:       route.Interval,
+		LateWindow:     route.LateWindow,
+		MaxCardinality: route.MaxCardinality,
 	}
 }
 
-func (route *Route) updatePattern(pattern string) error {
+// DestAddrs returns the comma-separated destination addresses, for display.
+func (route *Route) DestAddrs() string {
+	addrs := make([]string, len(route.Destinations))
+	for i, dest := range route.Destinations {
+		addrs[i] = dest.getAddr()
+	}
+	return strings.Join(addrs, ",")
+}
+
+// QueueDepths returns the comma-separated in-memory queue depths of this
+// route's destinations, in the same order as DestAddrs, for the admin "route
+// list" column.
+func (route *Route) QueueDepths() string {
+	depths := make([]string, len(route.Destinations))
+	for i, dest := range route.Destinations {
+		depths[i] = strconv.Itoa(dest.QueueDepth())
+	}
+	return strings.Join(depths, ",")
+}
+
+// SpoolDepths returns the comma-separated on-disk spool depths of this
+// route's destinations, in the same order as DestAddrs.
+func (route *Route) SpoolDepths() string {
+	depths := make([]string, len(route.Destinations))
+	for i, dest := range route.Destinations {
+		depths[i] = strconv.FormatInt(dest.SpoolDepth(), 10)
+	}
+	return strings.Join(depths, ",")
+}
+
+// LastErrors returns the comma-separated last connection error (or "" if
+// none) of this route's destinations, in the same order as DestAddrs.
+func (route *Route) LastErrors() string {
+	errs := make([]string, len(route.Destinations))
+	for i, dest := range route.Destinations {
+		errs[i] = dest.LastError()
+	}
+	return strings.Join(errs, ",")
+}
+
+// LastConnects returns the comma-separated last successful connect time (RFC
+// 3339, or "" if never connected) of this route's destinations, in the same
+// order as DestAddrs.
+func (route *Route) LastConnects() string {
+	times := make([]string, len(route.Destinations))
+	for i, dest := range route.Destinations {
+		if t := dest.LastConnect(); !t.IsZero() {
+			times[i] = t.Format(time.RFC3339)
+		}
+	}
+	return strings.Join(times, ",")
+}
+
+func (route *Route) compilePattern(pattern string) error {
 	regex, err := regexp.Compile(pattern)
 	if err != nil {
 		return err
@@ -73,122 +230,407 @@ func (route *Route) updatePattern(pattern string) error {
 	return nil
 }
 
+func (route *Route) updatePattern(pattern string) error {
+	if err := route.compilePattern(pattern); err != nil {
+		return err
+	}
+	publishEvent(route.events, "patt_update", route.Key, pattern)
+	return nil
+}
+
 func (route *Route) Run() (err error) {
-	route.ch = make(chan []byte)
-	route.shutdown = make(chan bool)
-	route.connUpdates = make(chan *net.TCPConn)
-	route.inConnUpdate = make(chan bool)
-	if route.Spool {
-		dqName := "spool_" + route.Key
-		route.queue = nsqd.NewDiskQueue(dqName, route.spoolDir, 200*1024*1024, 1000, 2*time.Second).(*nsqd.DiskQueue)
-	}
-	go route.relay()
-	return err
+	for _, dest := range route.Destinations {
+		if err := dest.Run(); err != nil {
+			return err
+		}
+	}
+	if route.agg != nil {
+		route.agg.Run()
+	}
+	return nil
 }
 
 func (route *Route) Shutdown() error {
-	if route.shutdown == nil {
+	for _, dest := range route.Destinations {
+		if err := dest.Shutdown(); err != nil {
+			return err
+		}
+	}
+	if route.agg != nil {
+		route.agg.Shutdown()
+	}
+	return nil
+}
+
+// dispatch publishes buf to live-tail subscribers and hands it off to
+// whichever destination(s) route.Kind selects, or, for Kind == "aggregate",
+// into the route's aggregator instead of any destination.
+func (route *Route) dispatch(buf []byte) {
+	route.publish(buf)
+	if route.Kind == "aggregate" {
+		route.aggregateSample(buf)
+		return
+	}
+	for _, dest := range route.destinationsFor(buf) {
+		dest.enqueue(buf)
+	}
+}
+
+func (route *Route) destinationsFor(buf []byte) []*Destination {
+	if len(route.Destinations) == 0 {
+		return nil
+	}
+	switch route.Kind {
+	case "replicate":
+		return route.Destinations
+	case "round_robin":
+		n := atomic.AddUint32(&route.rrCounter, 1)
+		idx := n % uint32(len(route.Destinations))
+		return route.Destinations[idx : idx+1]
+	case "consistent_hash":
+		dest := route.destinationForHash(buf)
+		if dest == nil {
+			return nil
+		}
+		return []*Destination{dest}
+	default: // "single"
+		return route.Destinations[:1]
+	}
+}
+
+// ringEntry is one virtual node on the consistent-hash ring.
+type ringEntry struct {
+	hash uint16
+	dest *Destination
+}
+
+type ringSlice []ringEntry
+
+func (r ringSlice) Len() int           { return len(r) }
+func (r ringSlice) Less(i, j int) bool { return r[i].hash < r[j].hash }
+func (r ringSlice) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+
+// fnv1a is Graphite's carbon-hash function: 32-bit FNV-1a. Callers truncate
+// the result to the 16 bits we ring on.
+func fnv1a(s string) uint32 {
+	var h uint32 = 2166136261
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
+
+// metricName returns the metric name (everything up to the first space) of a
+// plaintext graphite line, which is what destinations get hashed and looked
+// up by.
+func metricName(buf []byte) []byte {
+	if idx := bytes.IndexByte(buf, ' '); idx >= 0 {
+		return buf[:idx]
+	}
+	return buf
+}
+
+// buildRing lays vnodesPerDestination virtual nodes per destination on a
+// sorted 16-bit ring, Jump/carbon-hash style.
+func (route *Route) buildRing() {
+	ring := make(ringSlice, 0, len(route.Destinations)*vnodesPerDestination)
+	for _, dest := range route.Destinations {
+		for i := 0; i < vnodesPerDestination; i++ {
+			h := uint16(fnv1a(fmt.Sprintf("%s-%d", dest.Addr, i)))
+			ring = append(ring, ringEntry{hash: h, dest: dest})
+		}
+	}
+	sort.Sort(ring)
+	route.ring = ring
+}
+
+// destinationForHash finds the first ring entry whose hash is >= the
+// metric's hash, wrapping around to the start of the ring.
+func (route *Route) destinationForHash(buf []byte) *Destination {
+	if len(route.ring) == 0 {
+		return nil
+	}
+	h := uint16(fnv1a(string(metricName(buf))))
+	i := sort.Search(len(route.ring), func(i int) bool { return route.ring[i].hash >= h })
+	if i == len(route.ring) {
+		i = 0
+	}
+	return route.ring[i].dest
+}
+
+// DefaultQueueSize is how many metrics a destination buffers in memory,
+// between Dispatch and the relay goroutine, before it starts dropping.
+const DefaultQueueSize = 10000
+
+// Destination is a single TCP endpoint a Route can fan out to. It owns its
+// own connection, spool queue and stats, independently of its siblings, so
+// one misbehaving destination in a cluster never holds up the others.
+type Destination struct {
+	Addr       string         // tcp dest
+	routeKey   string         // owning route's key, for stats/logs
+	spoolDir   string         // where to store spool files (if enabled)
+	Spool      bool           // spool metrics to disk while endpoint down?
+	instrument *statsd.Client // to submit stats to
+	events     chan<- Event   // to publish route lifecycle events, if anyone's listening
+
+	QueueSize  int  // bounded in-memory queue capacity, 0 means DefaultQueueSize
+	DropNewest bool // on overflow, drop the incoming metric instead of the oldest queued one
+
+	// set in/via Run()
+	ch           chan []byte       // bounded queue feeding the relay goroutine
+	shutdown     chan bool         // signals shutdown internally
+	queue        *nsqd.DiskQueue   // queue used if spooling enabled
+	raddr        *net.TCPAddr      // resolved remote addr
+	connUpdates  chan *net.TCPConn // when the dest connects to a new endpoint (possibly nil)
+	inConnUpdate chan bool         // to signal when we start a new conn and when we finish
+
+	statusLock  sync.RWMutex
+	lastError   string
+	lastConnect time.Time
+}
+
+// after creating, run Run()!
+func NewDestination(routeKey, addr, spoolDir string, spool bool, queueSize int, dropNewest bool, instrument *statsd.Client, events chan<- Event) *Destination {
+	return &Destination{
+		Addr:       addr,
+		routeKey:   routeKey,
+		spoolDir:   spoolDir,
+		Spool:      spool,
+		QueueSize:  queueSize,
+		DropNewest: dropNewest,
+		instrument: instrument,
+		events:     events,
+	}
+}
+
+func (dest *Destination) Run() (err error) {
+	if dest.QueueSize == 0 {
+		dest.QueueSize = DefaultQueueSize
+	}
+	dest.ch = make(chan []byte, dest.QueueSize)
+	dest.shutdown = make(chan bool)
+	dest.connUpdates = make(chan *net.TCPConn)
+	dest.inConnUpdate = make(chan bool)
+	if dest.Spool {
+		dqName := "spool_" + dest.routeKey + "_" + strings.Replace(dest.Addr, ":", "_", -1)
+		dest.queue = nsqd.NewDiskQueue(dqName, dest.spoolDir, 200*1024*1024, 1000, 2*time.Second).(*nsqd.DiskQueue)
+	}
+	go dest.relay()
+	return err
+}
+
+// enqueue hands buf to the destination's bounded queue without blocking the
+// caller (Route.dispatch, called under Routes' read lock). When the queue is
+// full it drops the newest or oldest metric, per dest.DropNewest, and counts
+// the drop in statsd so operators can see which destination is the bottleneck.
+func (dest *Destination) enqueue(buf []byte) {
+	select {
+	case dest.ch <- buf:
+		return
+	default:
+	}
+	if dest.DropNewest {
+		dest.instrument.Increment("route=" + dest.routeKey + ".dest=" + dest.getAddr() + ".target_type=count.unit=Metric.direction=drop_overflow")
+		return
+	}
+	select {
+	case <-dest.ch:
+		dest.instrument.Increment("route=" + dest.routeKey + ".dest=" + dest.getAddr() + ".target_type=count.unit=Metric.direction=drop_overflow")
+	default:
+		// a consumer drained a slot between our full check and now
+	}
+	select {
+	case dest.ch <- buf:
+	default:
+		// queue filled right back up; drop the newest rather than spin
+		dest.instrument.Increment("route=" + dest.routeKey + ".dest=" + dest.getAddr() + ".target_type=count.unit=Metric.direction=drop_overflow")
+	}
+}
+
+// QueueDepth returns how many metrics are currently buffered in memory,
+// waiting to be sent to this destination.
+func (dest *Destination) QueueDepth() int {
+	return len(dest.ch)
+}
+
+// SpoolDepth returns how many metrics are currently spooled to disk.
+func (dest *Destination) SpoolDepth() int64 {
+	if dest.queue == nil {
+		return 0
+	}
+	return dest.queue.Depth()
+}
+
+// setAddr updates the destination's remote address, guarded by statusLock
+// since relay()/updateConn() read it concurrently from their own goroutine.
+func (dest *Destination) setAddr(addr string) {
+	dest.statusLock.Lock()
+	dest.Addr = addr
+	dest.statusLock.Unlock()
+}
+
+// getAddr returns the destination's current remote address.
+func (dest *Destination) getAddr() string {
+	dest.statusLock.RLock()
+	defer dest.statusLock.RUnlock()
+	return dest.Addr
+}
+
+func (dest *Destination) setLastError(s string) {
+	dest.statusLock.Lock()
+	dest.lastError = s
+	dest.statusLock.Unlock()
+}
+
+// LastError returns the last write/connect error seen by this destination, or "" if none.
+func (dest *Destination) LastError() string {
+	dest.statusLock.RLock()
+	defer dest.statusLock.RUnlock()
+	return dest.lastError
+}
+
+func (dest *Destination) setLastConnect(t time.Time) {
+	dest.statusLock.Lock()
+	dest.lastConnect = t
+	dest.statusLock.Unlock()
+}
+
+// LastConnect returns when this destination last successfully (re)connected.
+func (dest *Destination) LastConnect() time.Time {
+	dest.statusLock.RLock()
+	defer dest.statusLock.RUnlock()
+	return dest.lastConnect
+}
+
+func (dest *Destination) Shutdown() error {
+	if dest.shutdown == nil {
 		return errors.New("not running yet")
 	}
-	route.shutdown <- true
+	dest.shutdown <- true
 	return nil
 }
 
-func (route *Route) updateConn() error {
-	log.Printf("%v (re)connecting to %v\n", route.Key, route.Addr)
-	route.inConnUpdate <- true
-	defer func() { route.inConnUpdate <- false }()
-	raddr, err := net.ResolveTCPAddr("tcp", route.Addr)
+func (dest *Destination) updateConn() error {
+	fields := logrus.Fields{"route": dest.routeKey, "addr": dest.getAddr()}
+	if TraceConn {
+		logger.WithFields(fields).Info("(re)connecting")
+	}
+	dest.inConnUpdate <- true
+	defer func() { dest.inConnUpdate <- false }()
+	raddr, err := net.ResolveTCPAddr("tcp", dest.getAddr())
 	if nil != err {
-		log.Printf("%v resolve failed: %s\n", route.Key, err.Error())
+		logger.WithFields(fields).WithError(err).Warn("resolve failed")
+		dest.setLastError(err.Error())
 		return err
 	}
-	route.raddr = raddr
+	dest.raddr = raddr
 	laddr, _ := net.ResolveTCPAddr("tcp", "0.0.0.0")
-	new_conn, err := net.DialTCP("tcp", laddr, route.raddr)
+	new_conn, err := net.DialTCP("tcp", laddr, dest.raddr)
 	if nil != err {
-		log.Printf("%v connect failed: %s\n", route.Key, err.Error())
+		logger.WithFields(fields).WithError(err).Warn("connect failed")
+		dest.setLastError(err.Error())
 		return err
 	}
-	log.Printf("%v connected\n", route.Key)
-	route.connUpdates <- new_conn
+	logger.WithFields(fields).Info("connected")
+	dest.setLastConnect(time.Now())
+	publishEvent(dest.events, "connect", dest.routeKey, dest.getAddr())
+	dest.connUpdates <- new_conn
 	return nil
 }
 
 // TODO func (l *TCPListener) SetDeadline(t time.Time)
 // TODO Decide when to drop this buffer and move on.
-func (route *Route) relay() {
+func (dest *Destination) relay() {
 	period_assure_conn := time.Duration(60) * time.Second
 	ticker := time.NewTicker(period_assure_conn)
 	var to_unspool chan []byte
 	var conn *net.TCPConn
 
+	fields := logrus.Fields{"route": dest.routeKey, "addr": dest.getAddr()}
+
 	process_packet := func(buf []byte) {
 		if conn == nil {
-			if route.Spool {
-				route.instrument.Increment("route=" + route.Key + ".target_type=count.unit=Metric.direction=spool")
-				route.queue.Put(buf)
+			if dest.Spool {
+				dest.instrument.Increment("route=" + dest.routeKey + ".dest=" + dest.getAddr() + ".target_type=count.unit=Metric.direction=spool")
+				publishEvent(dest.events, "spool_in", dest.routeKey, dest.getAddr())
+				if TraceSpool {
+					logger.WithFields(fields).WithField("bytes", len(buf)).Info("spooling, no connection yet")
+				}
+				dest.queue.Put(buf)
 			} else {
 				// note, we drop packets while we set up connection
-				route.instrument.Increment("route=" + route.Key + ".target_type=count.unit=Metric.direction=drop")
+				dest.instrument.Increment("route=" + dest.routeKey + ".dest=" + dest.getAddr() + ".target_type=count.unit=Metric.direction=drop")
 			}
 			return
 		}
-		route.instrument.Increment("route=" + route.Key + ".target_type=count.unit=Metric.direction=out")
+		dest.instrument.Increment("route=" + dest.routeKey + ".dest=" + dest.getAddr() + ".target_type=count.unit=Metric.direction=out")
 		n, err := conn.Write(buf)
 		if nil != err {
-			route.instrument.Increment("route=" + route.Key + ".target_type=count.unit=Err")
-			log.Println(err)
+			dest.instrument.Increment("route=" + dest.routeKey + ".dest=" + dest.getAddr() + ".target_type=count.unit=Err")
+			logger.WithFields(fields).WithError(err).Warn("write failed")
+			dest.setLastError(err.Error())
 			conn.Close()
 			conn = nil
-			if route.Spool {
-				fmt.Println("writing to spool")
-				route.queue.Put(buf)
+			publishEvent(dest.events, "disconnect", dest.routeKey, err.Error())
+			if dest.Spool {
+				logger.WithFields(fields).WithField("bytes", len(buf)).Info("writing to spool")
+				publishEvent(dest.events, "spool_in", dest.routeKey, dest.getAddr())
+				dest.queue.Put(buf)
 			}
 			return
 		}
 		if len(buf) != n {
-			route.instrument.Increment("route=" + route.Key + ".target_type=count.unit=Err")
-			log.Printf(route.Key+" truncated: %s\n", buf)
+			dest.instrument.Increment("route=" + dest.routeKey + ".dest=" + dest.getAddr() + ".target_type=count.unit=Err")
+			logger.WithFields(fields).WithField("bytes", n).Warn("truncated write")
+			dest.setLastError("truncated write")
 			conn.Close()
 			conn = nil
-			if route.Spool {
-				fmt.Println("writing to spool")
-				route.queue.Put(buf)
+			publishEvent(dest.events, "disconnect", dest.routeKey, "truncated write")
+			if dest.Spool {
+				logger.WithFields(fields).WithField("bytes", len(buf)).Info("writing to spool")
+				publishEvent(dest.events, "spool_in", dest.routeKey, dest.getAddr())
+				dest.queue.Put(buf)
 			}
 		}
 	}
 
 	conn_updates := 0
-	go route.updateConn()
+	go dest.updateConn()
 
 	for {
 		// only process spool queue if we have an outbound connection
-		if conn != nil && route.Spool {
-			to_unspool = route.queue.ReadChan()
+		if conn != nil && dest.Spool {
+			to_unspool = dest.queue.ReadChan()
 		} else {
 			to_unspool = nil
 		}
 
 		select {
-		case inConnUpdate := <-route.inConnUpdate:
+		case inConnUpdate := <-dest.inConnUpdate:
 			if inConnUpdate {
 				conn_updates += 1
 			} else {
 				conn_updates -= 1
 			}
-		case new_conn := <-route.connUpdates:
+		case new_conn := <-dest.connUpdates:
 			conn = new_conn // can be nil and that's ok (it means we had to [re]connect but couldn't)
 		case <-ticker.C: // periodically try to bring connection (back) up, if we have to, and no other connect is happening
 			if conn == nil && conn_updates == 0 {
-				go route.updateConn()
+				if TraceConn {
+					logger.WithFields(fields).WithField("conn_updates", conn_updates).Info("assuring connection")
+				}
+				go dest.updateConn()
+			}
+		case <-dest.shutdown:
+			if TraceConn {
+				logger.WithFields(fields).Info("relay shutting down")
 			}
-		case <-route.shutdown:
-			//fmt.Println(route.Key + " route relay -> requested shutdown. quitting")
 			return
 		case buf := <-to_unspool:
+			publishEvent(dest.events, "spool_out", dest.routeKey, dest.getAddr())
 			process_packet(buf)
-		case buf := <-route.ch:
+		case buf := <-dest.ch:
 			process_packet(buf)
 		}
 	}
@@ -198,23 +640,144 @@ func (route *Route) relay() {
 type Routes struct {
 	Map      map[string]*Route
 	KeyList  []string
-	lock     sync.Mutex
+	lock     sync.RWMutex
 	SpoolDir string
+
+	unroutedLock sync.RWMutex
+	unrouted     []chan []byte // subscribers tailing metrics that matched no route
+
+	eventListenersLock sync.RWMutex
+	eventListeners     []chan Event
+	events             chan Event // every route feeds lifecycle notifications in here
 }
 
-func NewRoutes(routeDefsMap map[string]*Route, spoolDir string, instrument *statsd.Client) (routes *Routes, err error) {
+// RouteConfig is a plain data holder decoded straight from TOML; NewRoutes
+// turns it into a Route (started later by Routes.Run). Addr is kept around for Kind == "single" configs written before
+// Addrs/Kind existed. Template/Func/Interval/LateWindow/MaxCardinality only
+// apply when Kind == "aggregate"; Interval/LateWindow are duration strings
+// (e.g. "10s") so they decode straight from TOML.
+type RouteConfig struct {
+	Patt       string
+	Kind       string
+	Addr       string
+	Addrs      []string
+	Spool      bool
+	QueueSize  int
+	DropNewest bool
+
+	Template       string
+	Func           string
+	Interval       string
+	LateWindow     string
+	MaxCardinality int
+}
+
+func NewRoutes(routeDefsMap map[string]*RouteConfig, spoolDir string, instrument *statsd.Client) (routes *Routes, err error) {
+	events := make(chan Event, 100)
 	routesMap := make(map[string]*Route)
+	routes = &Routes{Map: routesMap, SpoolDir: spoolDir, events: events}
+	dispatchBack := func(buf []byte) { routes.Dispatch(buf, false) }
 	for k, routeDef := range routeDefsMap {
-		route, err := NewRoute(k, routeDef.Patt, routeDef.Addr, spoolDir, routeDef.Spool, instrument)
+		addrs := routeDef.Addrs
+		if len(addrs) == 0 && routeDef.Addr != "" {
+			addrs = []string{routeDef.Addr}
+		}
+		var agg *AggConfig
+		if routeDef.Kind == "aggregate" {
+			interval, err := time.ParseDuration(routeDef.Interval)
+			if err != nil {
+				return nil, err
+			}
+			lateWindow, err := time.ParseDuration(routeDef.LateWindow)
+			if err != nil && routeDef.LateWindow != "" {
+				return nil, err
+			}
+			agg = &AggConfig{
+				Template:       routeDef.Template,
+				Func:           routeDef.Func,
+				Interval:       interval,
+				LateWindow:     lateWindow,
+				MaxCardinality: routeDef.MaxCardinality,
+			}
+		}
+		route, err := NewRoute(k, routeDef.Patt, routeDef.Kind, addrs, spoolDir, routeDef.Spool, routeDef.QueueSize, routeDef.DropNewest, agg, dispatchBack, instrument, events)
 		if err != nil {
 			return nil, err
 		}
 		routesMap[k] = route
 	}
-	routes = &Routes{Map: routesMap, SpoolDir: spoolDir}
+	go routes.broadcastEvents()
 	return routes, nil
 }
 
+// broadcastEvents fans out route lifecycle events (published by every route
+// via the shared events channel) to whoever's currently tailing /ws/events.
+func (routes *Routes) broadcastEvents() {
+	for event := range routes.events {
+		routes.eventListenersLock.RLock()
+		for _, ch := range routes.eventListeners {
+			select {
+			case ch <- event:
+			default:
+				// slow subscriber, drop the event rather than block routing
+			}
+		}
+		routes.eventListenersLock.RUnlock()
+	}
+}
+
+// AddEventListener registers ch to receive route lifecycle events (connect,
+// disconnect, spool-in, spool-out, pattern/addr updates) as they happen.
+func (routes *Routes) AddEventListener(ch chan Event) {
+	routes.eventListenersLock.Lock()
+	defer routes.eventListenersLock.Unlock()
+	routes.eventListeners = append(routes.eventListeners, ch)
+}
+
+// RemoveEventListener unregisters a channel previously passed to AddEventListener.
+func (routes *Routes) RemoveEventListener(ch chan Event) {
+	routes.eventListenersLock.Lock()
+	defer routes.eventListenersLock.Unlock()
+	for i, l := range routes.eventListeners {
+		if l == ch {
+			routes.eventListeners = append(routes.eventListeners[:i], routes.eventListeners[i+1:]...)
+			return
+		}
+	}
+}
+
+// AddUnroutedListener registers ch to receive a copy of every metric that
+// fails to match any route.
+func (routes *Routes) AddUnroutedListener(ch chan []byte) {
+	routes.unroutedLock.Lock()
+	defer routes.unroutedLock.Unlock()
+	routes.unrouted = append(routes.unrouted, ch)
+}
+
+// RemoveUnroutedListener unregisters a channel previously passed to AddUnroutedListener.
+func (routes *Routes) RemoveUnroutedListener(ch chan []byte) {
+	routes.unroutedLock.Lock()
+	defer routes.unroutedLock.Unlock()
+	for i, l := range routes.unrouted {
+		if l == ch {
+			routes.unrouted = append(routes.unrouted[:i], routes.unrouted[i+1:]...)
+			return
+		}
+	}
+}
+
+func (routes *Routes) publishUnrouted(buf []byte) {
+	routes.unroutedLock.RLock()
+	defer routes.unroutedLock.RUnlock()
+	for _, ch := range routes.unrouted {
+		select {
+		case ch <- buf:
+		default:
+			// slow tail subscriber, drop rather than block dispatch
+		}
+	}
+}
+
 // not thread safe, run this once only
 func (routes *Routes) Run() error {
 	for _, route := range routes.Map {
@@ -226,42 +789,71 @@ func (routes *Routes) Run() error {
 	return nil
 }
 func (routes *Routes) Dispatch(buf []byte, first_only bool) (routed bool) {
-	//fmt.Println("entering dispatch")
-	routes.lock.Lock()
-	defer routes.lock.Unlock()
+	if TraceDispatch {
+		logger.WithField("bytes", len(buf)).Info("entering dispatch")
+	}
+	routes.lock.RLock()
+	defer routes.lock.RUnlock()
 	for _, key := range routes.KeyList {
 		route := routes.Map[key]
 		if route.Reg.Match(buf) {
 			routed = true
-			//fmt.Println("routing to " + route.Key)
-			route.ch <- buf
+			if TraceDispatch {
+				logger.WithField("route", route.Key).Info("routing to")
+			}
+			route.dispatch(buf)
 			if first_only {
 				break
 			}
 		}
 	}
-	//fmt.Println("Dispatched")
+	if !routed {
+		routes.publishUnrouted(buf)
+	}
+	if TraceDispatch {
+		logger.Info("dispatched")
+	}
 	return routed
 }
 
+// Get returns the route registered under key, if any. Safe for concurrent
+// use while routes are being added/removed by the admin interface.
+func (routes *Routes) Get(key string) (*Route, bool) {
+	routes.lock.RLock()
+	defer routes.lock.RUnlock()
+	route, found := routes.Map[key]
+	return route, found
+}
+
 func (routes *Routes) List() map[string]Route {
 	ret := make(map[string]Route)
-	routes.lock.Lock()
-	defer routes.lock.Unlock()
+	routes.lock.RLock()
+	defer routes.lock.RUnlock()
 	for k, v := range routes.Map {
 		ret[k] = *v.Copy()
 	}
 	return ret
 }
 
+// Add creates a "single"-kind route, i.e. the original one-key-one-addr behavior.
 func (routes *Routes) Add(key, patt, addr string, spool bool, instrument *statsd.Client) error {
+	return routes.addRoute(key, patt, "single", []string{addr}, spool, instrument)
+}
+
+// AddCluster creates a route that fans out to multiple destinations using
+// the given Kind ("replicate", "round_robin" or "consistent_hash").
+func (routes *Routes) AddCluster(key, patt, kind string, addrs []string, spool bool, instrument *statsd.Client) error {
+	return routes.addRoute(key, patt, kind, addrs, spool, instrument)
+}
+
+func (routes *Routes) addRoute(key, patt, kind string, addrs []string, spool bool, instrument *statsd.Client) error {
 	routes.lock.Lock()
 	defer routes.lock.Unlock()
 	_, found := routes.Map[key]
 	if found {
 		return errors.New("route with given key already exists")
 	}
-	route, err := NewRoute(key, patt, addr, routes.SpoolDir, spool, instrument)
+	route, err := NewRoute(key, patt, kind, addrs, routes.SpoolDir, spool, 0, false, nil, nil, instrument, routes.events)
 	if err != nil {
 		return err
 	}
@@ -270,6 +862,42 @@ func (routes *Routes) Add(key, patt, addr string, spool bool, instrument *statsd
 		return err
 	}
 	routes.Map[key] = route
+	routes.KeyList = append(routes.KeyList, key)
+	return nil
+}
+
+// AddAggregate creates an "aggregate"-kind route: metrics matching patt are
+// rewritten to an output name via template and accumulated using fn (sum,
+// avg, min, max, count, last, p50/p90/p99), flushing one line per output
+// bucket back into the dispatch path every interval. Samples up to
+// lateWindow past a bucket's close are still folded in; once maxCardinality
+// distinct output names are active, new ones are dropped (0 means
+// unlimited).
+func (routes *Routes) AddAggregate(key, patt, template, fn string, interval, lateWindow time.Duration, maxCardinality int, instrument *statsd.Client) error {
+	routes.lock.Lock()
+	defer routes.lock.Unlock()
+	_, found := routes.Map[key]
+	if found {
+		return errors.New("route with given key already exists")
+	}
+	agg := &AggConfig{
+		Template:       template,
+		Func:           fn,
+		Interval:       interval,
+		LateWindow:     lateWindow,
+		MaxCardinality: maxCardinality,
+	}
+	dispatchBack := func(buf []byte) { routes.Dispatch(buf, false) }
+	route, err := NewRoute(key, patt, "aggregate", nil, routes.SpoolDir, false, 0, false, agg, dispatchBack, instrument, routes.events)
+	if err != nil {
+		return err
+	}
+	err = route.Run()
+	if err != nil {
+		return err
+	}
+	routes.Map[key] = route
+	routes.KeyList = append(routes.KeyList, key)
 	return nil
 }
 
@@ -281,7 +909,12 @@ func (routes *Routes) Update(key string, addr, patt *string) error {
 		return errors.New("unknown route '" + key + "'")
 	}
 	if addr != nil {
-		return route.updateConn()
+		if len(route.Destinations) != 1 {
+			return errors.New("addr update is only supported for single-destination routes")
+		}
+		route.Destinations[0].setAddr(*addr)
+		publishEvent(routes.events, "addr_update", key, *addr)
+		return route.Destinations[0].updateConn()
 	}
 	if patt != nil {
 		err := route.updatePattern(*patt)
@@ -300,6 +933,12 @@ func (routes *Routes) Del(key string) error {
 		return errors.New("unknown route '" + key + "'")
 	}
 	delete(routes.Map, key)
+	for i, k := range routes.KeyList {
+		if k == key {
+			routes.KeyList = append(routes.KeyList[:i], routes.KeyList[i+1:]...)
+			break
+		}
+	}
 	err := route.Shutdown()
 	if err != nil {
 		// route removed from routing table but still trying to connect
@@ -0,0 +1,41 @@
+package routing
+
+import (
+	"os"
+	"strings"
+)
+
+// Trace gates, inspired by syncthing's STTRACE: set CRNGTRACE to a
+// comma-separated list of facilities (dispatch, spool, conn, admin, all) to
+// turn on verbose per-metric logging at those hot call sites, at runtime,
+// without recompiling.
+var (
+	TraceDispatch bool
+	TraceSpool    bool
+	TraceConn     bool
+	TraceAdmin    bool
+)
+
+func init() {
+	loadTrace(os.Getenv("CRNGTRACE"))
+}
+
+func loadTrace(val string) {
+	for _, tok := range strings.Split(val, ",") {
+		switch strings.TrimSpace(tok) {
+		case "dispatch":
+			TraceDispatch = true
+		case "spool":
+			TraceSpool = true
+		case "conn":
+			TraceConn = true
+		case "admin":
+			TraceAdmin = true
+		case "all":
+			TraceDispatch = true
+			TraceSpool = true
+			TraceConn = true
+			TraceAdmin = true
+		}
+	}
+}